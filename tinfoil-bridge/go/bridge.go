@@ -8,16 +8,13 @@
 package tinfoilbridge
 
 import (
-	"bufio"
+	"context"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"strings"
-	"sync"
-
-	tinfoil "github.com/tinfoilsh/tinfoil-go"
 
 	ehbpClient "github.com/tinfoilsh/encrypted-http-body-protocol/client"
 	ehbpIdentity "github.com/tinfoilsh/encrypted-http-body-protocol/identity"
@@ -31,46 +28,42 @@ const (
 )
 
 // ── Caching ──────────────────────────────────────────────────────────
-
-// cachedClient holds a verified Tinfoil HTTP client that is reused across
-// requests. The attestation check happens once during NewClientWithParams;
-// the HTTP client returned by HTTPClient() automatically re-verifies the
-// pinned TLS certificate on every connection.
-var (
-	mu         sync.Mutex
-	cachedHTTP *http.Client
-)
-
-// getVerifiedHTTPClient returns a Tinfoil-verified HTTP client. It caches the
-// client so attestation verification only happens once (or when re-init is needed).
+//
+// Verified clients and EHBP transports are cached per enclave by the active
+// EnclavePool (see enclavepool.go) rather than in single package globals, so
+// a RegisterEnclavePool call with several entries can keep more than one
+// enclave warm at once. getVerifiedHTTPClient/getEHBPTransport below are
+// thin conveniences over the pool's primary (first-registered) entry, used
+// by RenewalManager, which only ever re-verifies one enclave. The WebSocket
+// transport (websocket.go) also pins each connection to a single pool entry,
+// but holds onto that entry itself so it can re-verify against the pool
+// directly on reconnect. VerifiedChatCompletion*/ProxiedChatCompletion*
+// consult the full pool themselves for weighted selection and failover.
+
+// getVerifiedHTTPClient returns a Tinfoil-verified HTTP client for the
+// active pool's primary entry, caching it so attestation verification only
+// happens once (or when re-init is needed).
 func getVerifiedHTTPClient() (*http.Client, error) {
-	mu.Lock()
-	defer mu.Unlock()
-
-	if cachedHTTP != nil {
-		return cachedHTTP, nil
+	pool := getActivePool()
+	entry, ok := pool.primaryEntry()
+	if !ok {
+		return nil, fmt.Errorf("no enclaves configured")
 	}
-
-	client, err := tinfoil.NewClientWithParams(enclaveName, repoName)
-	if err != nil {
-		return nil, fmt.Errorf("tinfoil client init: %w", err)
-	}
-
-	cachedHTTP = client.HTTPClient()
-	return cachedHTTP, nil
+	return pool.verifiedClientFor(entry)
 }
 
-// EHBP transport (cached separately from the TLS-pinned client).
-var (
-	ehbpMu      sync.Mutex
-	cachedEHBP  *ehbpClient.Transport
-)
-
-// clearEHBPCache invalidates the cached EHBP transport (e.g. on key rotation).
-func clearEHBPCache() {
-	ehbpMu.Lock()
-	defer ehbpMu.Unlock()
-	cachedEHBP = nil
+// getEHBPTransport returns a cached EHBP transport for the active pool's
+// primary entry, verified against the Tinfoil enclave attestation and
+// holding the enclave's HPKE public key. Requests encrypted with this
+// transport can only be decrypted inside the genuine enclave — the proxy
+// server never sees plaintext.
+func getEHBPTransport() (*ehbpClient.Transport, error) {
+	pool := getActivePool()
+	entry, ok := pool.primaryEntry()
+	if !ok {
+		return nil, fmt.Errorf("no enclaves configured")
+	}
+	return pool.ehbpTransportFor(entry)
 }
 
 // buildOHTTPKeyConfig constructs an RFC 9458 key configuration from a raw
@@ -97,49 +90,6 @@ func buildOHTTPKeyConfig(hpkePublicKeyHex string) ([]byte, error) {
 	return b.Bytes()
 }
 
-// getEHBPTransport returns a cached EHBP transport that has verified the
-// Tinfoil enclave attestation and holds the enclave's HPKE public key.
-// Requests encrypted with this transport can only be decrypted inside the
-// genuine enclave — the proxy server never sees plaintext.
-func getEHBPTransport() (*ehbpClient.Transport, error) {
-	ehbpMu.Lock()
-	defer ehbpMu.Unlock()
-
-	if cachedEHBP != nil {
-		return cachedEHBP, nil
-	}
-
-	// Verify enclave attestation (fetches signed runtime measurements,
-	// validates certificate chain, checks Sigstore transparency log).
-	client, err := tinfoil.NewClientWithParams(enclaveName, repoName)
-	if err != nil {
-		return nil, fmt.Errorf("attestation failed: %w", err)
-	}
-
-	gt, err := client.Verify()
-	if err != nil {
-		return nil, fmt.Errorf("verify failed: %w", err)
-	}
-
-	hpkeKey := gt.HPKEPublicKey
-	if hpkeKey == "" {
-		return nil, fmt.Errorf("enclave did not provide HPKE public key")
-	}
-
-	config, err := buildOHTTPKeyConfig(hpkeKey)
-	if err != nil {
-		return nil, fmt.Errorf("build key config: %w", err)
-	}
-
-	transport, err := ehbpClient.NewTransportWithConfig("", config)
-	if err != nil {
-		return nil, fmt.Errorf("create EHBP transport: %w", err)
-	}
-
-	cachedEHBP = transport
-	return transport, nil
-}
-
 // ── Callbacks ────────────────────────────────────────────────────────
 
 // StreamCallback receives streaming chunks from Tinfoil.
@@ -152,27 +102,61 @@ type StreamCallback interface {
 
 // ── Direct (TLS-pinned) requests ─────────────────────────────────────
 
+// dialVerified picks enclaves from the active pool in weighted-round-robin
+// order and sends the chat completion request to each in turn, trying the
+// next entry on a network error or a 5xx response (an entry rejected for a
+// pinned-measurement mismatch is itself a failure from verifiedClientFor, so
+// it falls into the same retry path). A 4xx response is the caller's own
+// malformed request, not an enclave problem, so it's returned immediately
+// rather than triggering failover.
+func dialVerified(pool *EnclavePool, requestJson, apiKey string) (*http.Response, error) {
+	var lastErr error
+	for _, entry := range pool.orderedAttempts() {
+		httpClient, err := pool.verifiedClientFor(entry)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		req, err := http.NewRequest("POST", entry.APIBase+"/chat/completions", strings.NewReader(requestJson))
+		if err != nil {
+			return nil, fmt.Errorf("build request: %w", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			lastErr = fmt.Errorf("request failed (%s): %w", entry.Name, err)
+			continue
+		}
+		if resp.StatusCode >= 500 {
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			lastErr = fmt.Errorf("HTTP %d from %s: %s", resp.StatusCode, entry.Name, string(body))
+			continue
+		}
+		return resp, nil
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no enclaves configured")
+	}
+	return nil, lastErr
+}
+
 // VerifiedChatCompletion sends a non-streaming chat completion request
 // through Tinfoil's TEE-attested endpoint with full client-side attestation
 // verification and TLS certificate pinning. requestJson must be a valid
 // OpenAI chat completion request body. Returns the full response JSON.
+//
+// The enclave is chosen from the active EnclavePool (see enclavepool.go) by
+// weighted round-robin, failing over to the next configured enclave on a
+// network error or measurement-mismatch.
 func VerifiedChatCompletion(requestJson, apiKey string) (string, error) {
-	httpClient, err := getVerifiedHTTPClient()
+	resp, err := dialVerified(getActivePool(), requestJson, apiKey)
 	if err != nil {
 		return "", err
 	}
-
-	req, err := http.NewRequest("POST", apiBase+"/chat/completions", strings.NewReader(requestJson))
-	if err != nil {
-		return "", fmt.Errorf("build request: %w", err)
-	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+apiKey)
-
-	resp, err := httpClient.Do(req)
-	if err != nil {
-		return "", fmt.Errorf("request failed: %w", err)
-	}
 	defer resp.Body.Close()
 
 	body, err := io.ReadAll(resp.Body)
@@ -184,109 +168,138 @@ func VerifiedChatCompletion(requestJson, apiKey string) (string, error) {
 		return "", fmt.Errorf("HTTP %d: %s", resp.StatusCode, string(body))
 	}
 
+	defaultTranscript.RecordRequest(nowUnix(), requestJson, string(body), extractModel(requestJson))
 	return string(body), nil
 }
 
-// VerifiedChatCompletionStream sends a streaming chat completion request
-// through Tinfoil's TEE-attested endpoint with full client-side attestation
-// verification and TLS certificate pinning. SSE data chunks are delivered
-// to the callback. The function blocks until the stream completes.
-func VerifiedChatCompletionStream(requestJson, apiKey string, cb StreamCallback) error {
-	httpClient, err := getVerifiedHTTPClient()
-	if err != nil {
-		return err
-	}
-
-	req, err := http.NewRequest("POST", apiBase+"/chat/completions", strings.NewReader(requestJson))
+// doVerifiedStreamRequest builds and sends the streaming chat completion
+// request against the active pool, returning the open response body for the
+// caller to read as SSE. The caller must close resp.Body.
+func doVerifiedStreamRequest(requestJson, apiKey string) (*http.Response, error) {
+	resp, err := dialVerified(getActivePool(), requestJson, apiKey)
 	if err != nil {
-		return fmt.Errorf("build request: %w", err)
+		return nil, err
 	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+apiKey)
-
-	resp, err := httpClient.Do(req)
-	if err != nil {
-		return fmt.Errorf("request failed: %w", err)
-	}
-	defer resp.Body.Close()
 
 	if resp.StatusCode >= 400 {
+		defer resp.Body.Close()
 		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("HTTP %d: %s", resp.StatusCode, string(body))
+		return nil, fmt.Errorf("HTTP %d: %s", resp.StatusCode, string(body))
 	}
 
-	scanner := bufio.NewScanner(resp.Body)
-	for scanner.Scan() {
-		line := scanner.Text()
-		if !strings.HasPrefix(line, "data: ") {
-			continue
-		}
-		data := strings.TrimPrefix(line, "data: ")
-		if data == "[DONE]" {
-			cb.OnData("[DONE]")
-			break
-		}
-		if abort := cb.OnData(data); abort {
-			break
-		}
+	return resp, nil
+}
+
+// VerifiedChatCompletionStream sends a streaming chat completion request
+// through Tinfoil's TEE-attested endpoint with full client-side attestation
+// verification and TLS certificate pinning. SSE data chunks are delivered
+// to the callback as raw chunk JSON. The function blocks until the stream
+// completes. For demultiplexed events, use VerifiedChatCompletionStreamTyped.
+func VerifiedChatCompletionStream(requestJson, apiKey string, cb StreamCallback) error {
+	resp, err := doVerifiedStreamRequest(requestJson, apiKey)
+	if err != nil {
+		return err
 	}
+	defer resp.Body.Close()
 
-	if err := scanner.Err(); err != nil {
+	var transcript strings.Builder
+	err = streamSSE(resp.Body, func(data string) bool {
+		transcript.WriteString(data)
+		return cb.OnData(data)
+	})
+	if err != nil {
 		cb.OnError(err.Error())
 		return err
 	}
 
+	defaultTranscript.RecordRequest(nowUnix(), requestJson, transcript.String(), extractModel(requestJson))
 	return nil
 }
 
 // ── EHBP-encrypted proxy requests ────────────────────────────────────
 
-// ProxiedChatCompletion sends an EHBP-encrypted non-streaming chat completion
-// request through a proxy server. The proxy adds the Tinfoil API key and
-// forwards to the enclave. The HTTP body is end-to-end encrypted between
-// this client and the enclave — the proxy sees only metadata headers.
-//
-// The proxyURL must point to the proxy's chat completions endpoint
-// (e.g. "https://api.example.com/api/premium-llm-tinfoil").
-func ProxiedChatCompletion(requestJson, proxyURL, userId, signature string) (string, error) {
-	for attempt := 0; attempt < 2; attempt++ {
-		result, err := doProxiedCompletion(requestJson, proxyURL, userId, signature)
-		if err != nil {
-			var keyErr *ehbpIdentity.KeyConfigError
-			if errors.As(err, &keyErr) && attempt == 0 {
-				clearEHBPCache()
-				continue
+// dialProxied is dialVerified's counterpart for the EHBP-encrypted proxy
+// path: it walks the active pool's weighted-round-robin order, and for each
+// entry retries once locally on an EHBP key-config error (the proxy rotated
+// its key; clearing that one entry's cached transport and re-deriving it
+// fixes it without involving the rest of the pool) before moving on to the
+// next entry for a network error, 5xx, or a second key-config error in a row.
+// ctx governs the whole attempt sequence, so a caller that cancels it (e.g.
+// ProxiedChatWebSocket's per-requestId cancellation) aborts mid-failover too.
+func dialProxied(ctx context.Context, pool *EnclavePool, requestJson, proxyURL, userId, signature string) (*http.Response, string, error) {
+	var lastErr error
+	for _, entry := range pool.orderedAttempts() {
+		if err := ctx.Err(); err != nil {
+			return nil, "", err
+		}
+		for attempt := 0; attempt < 2; attempt++ {
+			resp, model, err := doProxiedAttempt(ctx, pool, entry, requestJson, proxyURL, userId, signature)
+			if err != nil {
+				var keyErr *ehbpIdentity.KeyConfigError
+				if errors.As(err, &keyErr) && attempt == 0 {
+					pool.clearEHBPEntry(entry.Name)
+					continue
+				}
+				lastErr = err
+				break
 			}
-			return "", err
+			return resp, model, nil
 		}
-		return result, nil
 	}
-	return "", fmt.Errorf("max retries exceeded")
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no enclaves configured")
+	}
+	return nil, "", lastErr
 }
 
-func doProxiedCompletion(requestJson, proxyURL, userId, signature string) (string, error) {
-	transport, err := getEHBPTransport()
+func doProxiedAttempt(ctx context.Context, pool *EnclavePool, entry EnclaveEntry, requestJson, proxyURL, userId, signature string) (*http.Response, string, error) {
+	transport, err := pool.ehbpTransportFor(entry)
 	if err != nil {
-		return "", err
+		return nil, "", err
 	}
 
 	httpClient := &http.Client{Transport: transport}
 
-	req, err := http.NewRequest("POST", proxyURL, strings.NewReader(requestJson))
+	req, err := http.NewRequestWithContext(ctx, "POST", proxyURL, strings.NewReader(requestJson))
 	if err != nil {
-		return "", fmt.Errorf("build request: %w", err)
+		return nil, "", fmt.Errorf("build request: %w", err)
 	}
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("X-Tinfoil-Enclave-Url", "https://"+enclaveName)
+	req.Header.Set("X-Tinfoil-Enclave-Url", "https://"+entry.Name)
 	req.Header.Set("X-User-Id", userId)
 	req.Header.Set("X-Signature", signature)
-	if model := extractModel(requestJson); model != "" {
+	model := extractModel(requestJson)
+	if model != "" {
 		req.Header.Set("X-Model", model)
 	}
 
 	resp, err := httpClient.Do(req)
 	if err != nil {
-		return "", fmt.Errorf("request failed: %w", err)
+		return nil, "", fmt.Errorf("request failed (%s): %w", entry.Name, err)
+	}
+	if resp.StatusCode >= 500 {
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, "", fmt.Errorf("HTTP %d from %s: %s", resp.StatusCode, entry.Name, string(body))
+	}
+
+	return resp, model, nil
+}
+
+// ProxiedChatCompletion sends an EHBP-encrypted non-streaming chat completion
+// request through a proxy server. The proxy adds the Tinfoil API key and
+// forwards to the enclave. The HTTP body is end-to-end encrypted between
+// this client and the enclave — the proxy sees only metadata headers.
+//
+// The proxyURL must point to the proxy's chat completions endpoint
+// (e.g. "https://api.example.com/api/premium-llm-tinfoil"). The enclave
+// named in the X-Tinfoil-Enclave-Url header is chosen from the active
+// EnclavePool, with the same weighted-round-robin failover as
+// VerifiedChatCompletion.
+func ProxiedChatCompletion(requestJson, proxyURL, userId, signature string) (string, error) {
+	resp, model, err := dialProxied(context.Background(), getActivePool(), requestJson, proxyURL, userId, signature)
+	if err != nil {
+		return "", err
 	}
 	defer resp.Body.Close()
 
@@ -299,6 +312,7 @@ func doProxiedCompletion(requestJson, proxyURL, userId, signature string) (strin
 		return "", fmt.Errorf("HTTP %d: %s", resp.StatusCode, string(body))
 	}
 
+	defaultTranscript.RecordRequest(nowUnix(), requestJson, string(body), model)
 	return string(body), nil
 }
 
@@ -307,75 +321,37 @@ func doProxiedCompletion(requestJson, proxyURL, userId, signature string) (strin
 // the proxy never sees plaintext prompts or completions. SSE data chunks
 // are delivered to the callback after client-side EHBP decryption.
 func ProxiedChatCompletionStream(requestJson, proxyURL, userId, signature string, cb StreamCallback) error {
-	for attempt := 0; attempt < 2; attempt++ {
-		err := doProxiedStream(requestJson, proxyURL, userId, signature, cb)
-		if err != nil {
-			var keyErr *ehbpIdentity.KeyConfigError
-			if errors.As(err, &keyErr) && attempt == 0 {
-				clearEHBPCache()
-				continue
-			}
-			return err
-		}
-		return nil
-	}
-	return fmt.Errorf("max retries exceeded")
+	return doProxiedStream(requestJson, proxyURL, userId, signature, cb)
+}
+
+// doProxiedStreamRequest builds and sends the EHBP-encrypted streaming
+// request, returning the (already-decrypted by the transport) response body
+// for the caller to read as SSE, plus the extracted model name for transcript
+// recording. The caller must close resp.Body.
+func doProxiedStreamRequest(requestJson, proxyURL, userId, signature string) (*http.Response, string, error) {
+	return dialProxied(context.Background(), getActivePool(), requestJson, proxyURL, userId, signature)
 }
 
 func doProxiedStream(requestJson, proxyURL, userId, signature string, cb StreamCallback) error {
-	transport, err := getEHBPTransport()
+	resp, model, err := doProxiedStreamRequest(requestJson, proxyURL, userId, signature)
 	if err != nil {
 		return err
 	}
-
-	httpClient := &http.Client{Transport: transport}
-
-	req, err := http.NewRequest("POST", proxyURL, strings.NewReader(requestJson))
-	if err != nil {
-		return fmt.Errorf("build request: %w", err)
-	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("X-Tinfoil-Enclave-Url", "https://"+enclaveName)
-	req.Header.Set("X-User-Id", userId)
-	req.Header.Set("X-Signature", signature)
-	if model := extractModel(requestJson); model != "" {
-		req.Header.Set("X-Model", model)
-	}
-
-	resp, err := httpClient.Do(req)
-	if err != nil {
-		return fmt.Errorf("request failed: %w", err)
-	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode >= 400 {
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("HTTP %d: %s", resp.StatusCode, string(body))
-	}
-
 	// The EHBP transport has already decrypted the response body.
 	// We read plaintext SSE data from it.
-	scanner := bufio.NewScanner(resp.Body)
-	for scanner.Scan() {
-		line := scanner.Text()
-		if !strings.HasPrefix(line, "data: ") {
-			continue
-		}
-		data := strings.TrimPrefix(line, "data: ")
-		if data == "[DONE]" {
-			cb.OnData("[DONE]")
-			break
-		}
-		if abort := cb.OnData(data); abort {
-			break
-		}
-	}
-
-	if err := scanner.Err(); err != nil {
+	var transcript strings.Builder
+	err = streamSSE(resp.Body, func(data string) bool {
+		transcript.WriteString(data)
+		return cb.OnData(data)
+	})
+	if err != nil {
 		cb.OnError(err.Error())
 		return err
 	}
 
+	defaultTranscript.RecordRequest(nowUnix(), requestJson, transcript.String(), model)
 	return nil
 }
 
@@ -0,0 +1,261 @@
+package tinfoilbridge
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+
+	tinfoil "github.com/tinfoilsh/tinfoil-go"
+
+	ehbpClient "github.com/tinfoilsh/encrypted-http-body-protocol/client"
+)
+
+// ── EnclavePool ───────────────────────────────────────────────────────
+//
+// Before this, enclaveName/repoName/apiBase were fixed constants: the bridge
+// could only ever talk to one enclave, and any attestation Sigstore accepted
+// was trusted. EnclavePool lets the Android app configure several enclaves
+// (for regional failover) and pin each one to a specific set of measurement
+// hashes it shipped with the app version, rejecting an otherwise-valid
+// attestation whose measurement isn't in that allowlist — defense against a
+// compromised Sigstore log, not just a compromised enclave.
+
+// EnclaveEntry describes one enclave the pool may route requests to.
+type EnclaveEntry struct {
+	Name    string
+	Repo    string
+	APIBase string
+	// AllowedMeasurements pins this entry to specific measurement
+	// fingerprints (GroundTruth.EnclaveFingerprint — the SHA-256 hash over
+	// the enclave's measurement registers, not the raw multi-register
+	// attestation.Measurement struct itself). An attestation that Sigstore
+	// validates but whose fingerprint isn't in this list is rejected. Empty
+	// means trust any Sigstore-valid result, matching the bridge's original
+	// behavior.
+	AllowedMeasurements []string
+	// Weight controls how often this entry is chosen relative to others in
+	// weighted round-robin selection. Entries with Weight <= 0 are treated
+	// as Weight 1.
+	Weight int
+}
+
+func (e EnclaveEntry) weight() int {
+	if e.Weight <= 0 {
+		return 1
+	}
+	return e.Weight
+}
+
+func (e EnclaveEntry) measurementAllowed(measurement string) bool {
+	if len(e.AllowedMeasurements) == 0 {
+		return true
+	}
+	for _, m := range e.AllowedMeasurements {
+		if m == measurement {
+			return true
+		}
+	}
+	return false
+}
+
+// EnclavePool selects among several enclaves by weighted round-robin,
+// caching verified clients per enclave, and is what VerifiedChatCompletion*/
+// ProxiedChatCompletion* consult instead of the single cachedHTTP/cachedEHBP
+// globals they used before.
+type EnclavePool struct {
+	entries []EnclaveEntry
+
+	mu      sync.Mutex
+	current []int // smooth weighted round-robin counters, parallel to entries
+
+	clientMu sync.Mutex
+	clients  map[string]*http.Client
+	ehbpMu   sync.Mutex
+	ehbp     map[string]*ehbpClient.Transport
+}
+
+// NewEnclavePool constructs a pool over the given entries. Order is
+// preserved as the failover order after the weighted pick.
+func NewEnclavePool(entries []EnclaveEntry) *EnclavePool {
+	return &EnclavePool{
+		entries: entries,
+		current: make([]int, len(entries)),
+		clients: make(map[string]*http.Client),
+		ehbp:    make(map[string]*ehbpClient.Transport),
+	}
+}
+
+func (p *EnclavePool) totalWeight() int {
+	total := 0
+	for _, e := range p.entries {
+		total += e.weight()
+	}
+	return total
+}
+
+// nextIndexLocked implements smooth weighted round-robin (the same
+// algorithm nginx uses for weighted upstream selection): each entry
+// accumulates its weight every call, the highest accumulator is picked, and
+// that entry's accumulator is reduced by the total weight.
+func (p *EnclavePool) nextIndexLocked() int {
+	best := -1
+	total := p.totalWeight()
+	for i, e := range p.entries {
+		p.current[i] += e.weight()
+		if best == -1 || p.current[i] > p.current[best] {
+			best = i
+		}
+	}
+	if best >= 0 {
+		p.current[best] -= total
+	}
+	return best
+}
+
+// orderedAttempts returns every entry once, starting from this call's
+// weighted-round-robin pick and then following pool order, so a caller can
+// fail over through the rest of the pool without re-weighting mid-attempt.
+func (p *EnclavePool) orderedAttempts() []EnclaveEntry {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	n := len(p.entries)
+	if n == 0 {
+		return nil
+	}
+	start := p.nextIndexLocked()
+	ordered := make([]EnclaveEntry, n)
+	for i := 0; i < n; i++ {
+		ordered[i] = p.entries[(start+i)%n]
+	}
+	return ordered
+}
+
+// verifiedClientFor returns a cached, Tinfoil-verified TLS-pinned HTTP
+// client for entry, re-verifying and rejecting the result if its measurement
+// isn't in entry's allowlist. clientMu is held for the whole call, including
+// the network verification, so two concurrent callers for the same entry
+// (e.g. a reconnecting WebSocket racing a renewal) can't both pay for a
+// redundant attestation — the second just gets the first's cached result.
+func (p *EnclavePool) verifiedClientFor(entry EnclaveEntry) (*http.Client, error) {
+	p.clientMu.Lock()
+	defer p.clientMu.Unlock()
+
+	if c, ok := p.clients[entry.Name]; ok {
+		return c, nil
+	}
+
+	client, err := tinfoil.NewClientWithParams(entry.Name, entry.Repo)
+	if err != nil {
+		return nil, fmt.Errorf("tinfoil client init (%s): %w", entry.Name, err)
+	}
+
+	gt, err := client.Verify()
+	if err != nil {
+		return nil, fmt.Errorf("verify failed (%s): %w", entry.Name, err)
+	}
+	if !entry.measurementAllowed(gt.EnclaveFingerprint) {
+		return nil, fmt.Errorf("enclave %s: measurement %q is not in the pinned allowlist", entry.Name, gt.EnclaveFingerprint)
+	}
+	recordAttestation(gt)
+	recordVerification(entry.Name, entry.Repo, gt, nil)
+
+	httpClient := client.HTTPClient()
+	p.clients[entry.Name] = httpClient
+	return httpClient, nil
+}
+
+// ehbpTransportFor returns a cached EHBP transport for entry, analogous to
+// verifiedClientFor but for the EHBP-encrypted proxy path. ehbpMu is held
+// for the whole call for the same single-flight reason as verifiedClientFor.
+func (p *EnclavePool) ehbpTransportFor(entry EnclaveEntry) (*ehbpClient.Transport, error) {
+	p.ehbpMu.Lock()
+	defer p.ehbpMu.Unlock()
+
+	if t, ok := p.ehbp[entry.Name]; ok {
+		return t, nil
+	}
+
+	client, err := tinfoil.NewClientWithParams(entry.Name, entry.Repo)
+	if err != nil {
+		return nil, fmt.Errorf("attestation failed (%s): %w", entry.Name, err)
+	}
+	gt, err := client.Verify()
+	if err != nil {
+		return nil, fmt.Errorf("verify failed (%s): %w", entry.Name, err)
+	}
+	if !entry.measurementAllowed(gt.EnclaveFingerprint) {
+		return nil, fmt.Errorf("enclave %s: measurement %q is not in the pinned allowlist", entry.Name, gt.EnclaveFingerprint)
+	}
+
+	hpkeKey := gt.HPKEPublicKey
+	if hpkeKey == "" {
+		return nil, fmt.Errorf("enclave %s did not provide HPKE public key", entry.Name)
+	}
+	config, err := buildOHTTPKeyConfig(hpkeKey)
+	if err != nil {
+		return nil, fmt.Errorf("build key config (%s): %w", entry.Name, err)
+	}
+	recordAttestation(gt)
+	recordVerification(entry.Name, entry.Repo, gt, config)
+
+	transport, err := ehbpClient.NewTransportWithConfig("", config)
+	if err != nil {
+		return nil, fmt.Errorf("create EHBP transport (%s): %w", entry.Name, err)
+	}
+
+	p.ehbp[entry.Name] = transport
+	return transport, nil
+}
+
+// clearEHBPEntry invalidates one entry's cached EHBP transport, used on
+// key-config errors the same way clearEHBPCache used to for the singleton.
+func (p *EnclavePool) clearEHBPEntry(name string) {
+	p.ehbpMu.Lock()
+	defer p.ehbpMu.Unlock()
+	delete(p.ehbp, name)
+}
+
+// invalidate drops both cached entries (verified client and EHBP transport)
+// for name, forcing the next lookup to re-verify. Used by RenewalManager.
+func (p *EnclavePool) invalidate(name string) {
+	p.clientMu.Lock()
+	delete(p.clients, name)
+	p.clientMu.Unlock()
+	p.clearEHBPEntry(name)
+}
+
+// primaryEntry returns the pool's first-registered entry, used by
+// subsystems (RenewalManager, the WebSocket transport) that only ever talk
+// to a single enclave rather than fanning out across the pool.
+func (p *EnclavePool) primaryEntry() (EnclaveEntry, bool) {
+	if len(p.entries) == 0 {
+		return EnclaveEntry{}, false
+	}
+	return p.entries[0], true
+}
+
+// ── Package-wide active pool ──────────────────────────────────────────
+
+var (
+	activePoolMu sync.Mutex
+	activePool   = NewEnclavePool([]EnclaveEntry{
+		{Name: enclaveName, Repo: repoName, APIBase: apiBase, Weight: 1},
+	})
+)
+
+// RegisterEnclavePool replaces the package-wide enclave pool that
+// VerifiedChatCompletion*/ProxiedChatCompletion* draw from. Call it once at
+// app startup to pin the enclaves this app version trusts and, optionally,
+// configure regional failover.
+func RegisterEnclavePool(pool *EnclavePool) {
+	activePoolMu.Lock()
+	defer activePoolMu.Unlock()
+	activePool = pool
+}
+
+func getActivePool() *EnclavePool {
+	activePoolMu.Lock()
+	defer activePoolMu.Unlock()
+	return activePool
+}
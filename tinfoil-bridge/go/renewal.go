@@ -0,0 +1,250 @@
+package tinfoilbridge
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	tinfoilclient "github.com/tinfoilsh/tinfoil-go/verifier/client"
+)
+
+// ── Attestation tracking ─────────────────────────────────────────────
+//
+// attestInfo holds the most recently verified GroundTruth, populated by
+// getVerifiedHTTPClient, getEHBPTransport, and RenewalManager alike so
+// CurrentAttestation always reflects whichever path last re-verified.
+
+var (
+	attestMu   sync.Mutex
+	attestInfo Attestation
+)
+
+// Attestation is a snapshot of the enclave's verified ground truth, exposed
+// to the Android app so the UI can display what it's currently trusting.
+type Attestation struct {
+	Measurement     string // signed measurement hash from the enclave
+	HPKEFingerprint string // hex-encoded HPKE public key currently pinned
+	VerifiedAtUnix  int64  // unix seconds of the last successful verification
+}
+
+// recordAttestation updates the shared attestation snapshot from a freshly
+// verified GroundTruth. It does not touch the EnclavePool's cached clients or
+// transports itself.
+func recordAttestation(gt *tinfoilclient.GroundTruth) {
+	attestMu.Lock()
+	defer attestMu.Unlock()
+	attestInfo = Attestation{
+		Measurement:     gt.EnclaveFingerprint,
+		HPKEFingerprint: gt.HPKEPublicKey,
+		VerifiedAtUnix:  nowUnix(),
+	}
+}
+
+// CurrentAttestation returns the most recently verified attestation snapshot.
+// It returns the zero Attestation if no verification has happened yet.
+func CurrentAttestation() *Attestation {
+	attestMu.Lock()
+	defer attestMu.Unlock()
+	a := attestInfo
+	return &a
+}
+
+// nowUnix exists so the one non-deterministic call in this file is easy to
+// spot and, if ever needed, fake out in tests.
+func nowUnix() int64 {
+	return time.Now().Unix()
+}
+
+// ── RenewalManager ───────────────────────────────────────────────────
+
+// RenewalCallback receives lifecycle events from a RenewalManager, mirrored
+// as a gomobile-friendly interface so the Android app can surface renewal
+// state (e.g. a "re-attested" toast, or a warning banner on failure).
+type RenewalCallback interface {
+	OnRenewed(measurement string)
+	OnRenewalFailed(err string)
+	OnMeasurementChanged(old, new string)
+}
+
+// RenewalManager periodically re-verifies the Tinfoil enclave attestation in
+// the background and swaps in the freshly verified client/transport, the
+// same way golang.org/x/crypto/acme/autocert.Manager renews TLS certificates
+// ahead of expiry. Without this, a verified client or transport is trusted
+// forever once cached, even after the enclave rotates its HPKE key or ships
+// a new measurement.
+//
+// The zero value is not ready to use; construct one with NewRenewalManager.
+type RenewalManager struct {
+	// MinTTL is the minimum time a verification is considered fresh; renewal
+	// is skipped if the last successful verification is younger than this.
+	MinTTL time.Duration
+	// RenewBefore is how long before a verification is "due" that the
+	// manager starts attempting renewal (kept for parity with autocert's
+	// RenewBefore; Tinfoil attestations don't carry an expiry of their own,
+	// so this is measured from the last successful verification).
+	RenewBefore time.Duration
+	// CheckInterval is how often the background goroutine wakes up to
+	// decide whether a renewal is due.
+	CheckInterval time.Duration
+
+	cb RenewalCallback
+
+	mu      sync.Mutex
+	stopCh  chan struct{}
+	running bool
+}
+
+const (
+	defaultMinTTL        = 5 * time.Minute
+	defaultRenewBefore   = 30 * time.Minute
+	defaultCheckInterval = 1 * time.Minute
+)
+
+// NewRenewalManager creates a RenewalManager with autocert-style defaults
+// (MinTTL=5m, RenewBefore=30m, CheckInterval=1m). Callers may override the
+// fields before calling Start.
+func NewRenewalManager(cb RenewalCallback) *RenewalManager {
+	return &RenewalManager{
+		MinTTL:        defaultMinTTL,
+		RenewBefore:   defaultRenewBefore,
+		CheckInterval: defaultCheckInterval,
+		cb:            cb,
+	}
+}
+
+// Start launches the background renewal goroutine. It is a no-op if already
+// running.
+func (m *RenewalManager) Start() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.running {
+		return
+	}
+	m.stopCh = make(chan struct{})
+	m.running = true
+	go m.loop(m.stopCh)
+}
+
+// Stop halts the background renewal goroutine. It is a no-op if not running.
+func (m *RenewalManager) Stop() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.running {
+		return
+	}
+	close(m.stopCh)
+	m.running = false
+}
+
+func (m *RenewalManager) loop(stopCh chan struct{}) {
+	interval := m.CheckInterval
+	if interval <= 0 {
+		interval = defaultCheckInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			if m.renewalDue() {
+				m.renew()
+			}
+		}
+	}
+}
+
+func (m *RenewalManager) renewalDue() bool {
+	last := CurrentAttestation().VerifiedAtUnix
+	if last == 0 {
+		return true
+	}
+	age := time.Since(time.Unix(last, 0))
+	minTTL := m.MinTTL
+	if minTTL <= 0 {
+		minTTL = defaultMinTTL
+	}
+	renewBefore := m.RenewBefore
+	if renewBefore <= 0 {
+		renewBefore = defaultRenewBefore
+	}
+	return age >= minTTL && age >= renewBefore
+}
+
+// renew re-runs attestation verification for the active pool's primary
+// entry and, on success, replaces its cached HTTP client and EHBP transport
+// so subsequent requests pick up the refreshed attestation. Requests already
+// in flight keep the client or transport they started with.
+func (m *RenewalManager) renew() {
+	oldMeasurement := CurrentAttestation().Measurement
+
+	pool := getActivePool()
+	entry, ok := pool.primaryEntry()
+	if !ok {
+		m.notifyFailed(fmt.Errorf("no enclaves configured"))
+		return
+	}
+	pool.invalidate(entry.Name)
+
+	if _, err := getVerifiedHTTPClient(); err != nil {
+		m.notifyFailed(fmt.Errorf("tinfoil client init: %w", err))
+		return
+	}
+	if _, err := getEHBPTransport(); err != nil {
+		m.notifyFailed(err)
+		return
+	}
+
+	newMeasurement := CurrentAttestation().Measurement
+	if m.cb != nil {
+		if oldMeasurement != "" && oldMeasurement != newMeasurement {
+			m.cb.OnMeasurementChanged(oldMeasurement, newMeasurement)
+		}
+		m.cb.OnRenewed(newMeasurement)
+	}
+}
+
+func (m *RenewalManager) notifyFailed(err error) {
+	if m.cb != nil {
+		m.cb.OnRenewalFailed(err.Error())
+	}
+}
+
+// ── Package-level convenience for the Android app ────────────────────
+
+var (
+	defaultRenewalMu sync.Mutex
+	defaultRenewal   *RenewalManager
+)
+
+// StartRenewalManager installs and starts the package-wide RenewalManager
+// used by ForceRenew. Calling it again replaces the previous manager,
+// stopping it first.
+func StartRenewalManager(cb RenewalCallback) *RenewalManager {
+	defaultRenewalMu.Lock()
+	defer defaultRenewalMu.Unlock()
+
+	if defaultRenewal != nil {
+		defaultRenewal.Stop()
+	}
+	defaultRenewal = NewRenewalManager(cb)
+	defaultRenewal.Start()
+	return defaultRenewal
+}
+
+// ForceRenew triggers an immediate re-verification and cache swap, for the
+// Android app to call on foreground resume rather than waiting for the next
+// scheduled check. If no RenewalManager has been started, it performs a
+// one-off renewal with no callback.
+func ForceRenew() {
+	defaultRenewalMu.Lock()
+	m := defaultRenewal
+	defaultRenewalMu.Unlock()
+
+	if m == nil {
+		m = &RenewalManager{}
+	}
+	m.renew()
+}
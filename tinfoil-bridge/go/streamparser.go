@@ -0,0 +1,270 @@
+package tinfoilbridge
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+)
+
+// ── StreamParser ──────────────────────────────────────────────────────
+//
+// bufio.Scanner's default 64 KiB max token size means a single long SSE
+// "data:" line — an image-URL model output, a batched delta, or a large
+// tool-call arguments chunk — kills the stream with bufio.ErrTooLong.
+// StreamParser replaces the scanner with a bufio.Reader-based line reader
+// whose max line size is configurable, and understands the SSE field set
+// ("data:", "event:", "id:", "retry:") and multi-line data continuations
+// rather than only the bare "data: " prefix the old scanner loop checked for.
+
+const defaultMaxStreamLineBytes = 4 << 20 // 4 MiB
+
+var maxStreamLineBytes int64 = defaultMaxStreamLineBytes
+
+// SetMaxStreamLineBytes overrides the maximum size of a single raw SSE line
+// that VerifiedChatCompletionStream, ProxiedChatCompletionStream, and their
+// Typed variants will buffer before failing the stream. The default is 4 MiB.
+// The limit applies to each line on its own; the joined data of a multi-line
+// "data:" event is not limited as a whole.
+func SetMaxStreamLineBytes(n int) {
+	atomic.StoreInt64(&maxStreamLineBytes, int64(n))
+}
+
+func currentMaxStreamLineBytes() int {
+	return int(atomic.LoadInt64(&maxStreamLineBytes))
+}
+
+// sseEvent is one complete SSE event: the "data:" lines joined with "\n" per
+// the spec, plus whichever of "event:"/"id:"/"retry:" were present.
+type sseEvent struct {
+	Event string
+	ID    string
+	Retry string
+	Data  string
+}
+
+// sseReader reads SSE events from r, accepting both "\n" and "\r\n" line
+// endings and enforcing maxLineBytes on each raw line.
+type sseReader struct {
+	br           *bufio.Reader
+	maxLineBytes int
+}
+
+func newSSEReader(r io.Reader, maxLineBytes int) *sseReader {
+	return &sseReader{br: bufio.NewReaderSize(r, 4096), maxLineBytes: maxLineBytes}
+}
+
+// readLine returns the next line with its trailing "\r\n"/"\n" stripped. It
+// keeps reading past bufio's internal buffer boundary so a line can exceed
+// the reader's internal buffer size without being split, up to maxLineBytes.
+func (s *sseReader) readLine() (string, error) {
+	var buf []byte
+	for {
+		chunk, err := s.br.ReadSlice('\n')
+		buf = append(buf, chunk...)
+		if len(buf) > s.maxLineBytes {
+			return "", fmt.Errorf("stream line exceeds %d bytes", s.maxLineBytes)
+		}
+		if err == nil {
+			break
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err == io.EOF {
+			if len(buf) == 0 {
+				return "", io.EOF
+			}
+			break
+		}
+		return "", err
+	}
+
+	line := strings.TrimSuffix(string(buf), "\n")
+	line = strings.TrimSuffix(line, "\r")
+	return line, nil
+}
+
+// Next reads and returns the next complete SSE event (terminated by a blank
+// line), or io.EOF once the stream ends with no event pending.
+func (s *sseReader) Next() (*sseEvent, error) {
+	var ev sseEvent
+	var dataLines []string
+	haveField := false
+
+	for {
+		line, err := s.readLine()
+		if err != nil {
+			if err == io.EOF {
+				if haveField {
+					ev.Data = strings.Join(dataLines, "\n")
+					return &ev, nil
+				}
+				return nil, io.EOF
+			}
+			return nil, err
+		}
+
+		if line == "" {
+			if !haveField {
+				continue // blank keep-alive between events
+			}
+			ev.Data = strings.Join(dataLines, "\n")
+			return &ev, nil
+		}
+		if strings.HasPrefix(line, ":") {
+			continue // comment
+		}
+
+		haveField = true
+		switch {
+		case strings.HasPrefix(line, "data:"):
+			dataLines = append(dataLines, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		case strings.HasPrefix(line, "event:"):
+			ev.Event = strings.TrimPrefix(strings.TrimPrefix(line, "event:"), " ")
+		case strings.HasPrefix(line, "id:"):
+			ev.ID = strings.TrimPrefix(strings.TrimPrefix(line, "id:"), " ")
+		case strings.HasPrefix(line, "retry:"):
+			ev.Retry = strings.TrimPrefix(strings.TrimPrefix(line, "retry:"), " ")
+		}
+	}
+}
+
+// streamSSE reads SSE "data:" events from body and invokes onData for each
+// one, in arrival order, until the stream ends, onData aborts the stream, or
+// a "[DONE]" sentinel is seen. It is the shared engine behind both the
+// legacy StreamCallback-based functions and the newer Typed variants.
+func streamSSE(body io.Reader, onData func(data string) bool) error {
+	reader := newSSEReader(body, currentMaxStreamLineBytes())
+	for {
+		ev, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if ev.Data == "" {
+			continue
+		}
+		if onData(ev.Data) {
+			return nil
+		}
+		if ev.Data == "[DONE]" {
+			return nil
+		}
+	}
+}
+
+// ── TypedStreamCallback ───────────────────────────────────────────────
+
+// TypedStreamCallback receives demultiplexed OpenAI chat completion stream
+// events, so Android callers no longer have to parse chunk JSON themselves.
+type TypedStreamCallback interface {
+	OnContentDelta(role, content string)
+	OnToolCallDelta(id, name, argsChunk string)
+	OnFinish(reason string)
+	OnUsage(prompt, completion int)
+	OnError(err string)
+}
+
+type chatCompletionChunk struct {
+	Choices []struct {
+		Delta struct {
+			Role      string `json:"role,omitempty"`
+			Content   string `json:"content,omitempty"`
+			ToolCalls []struct {
+				ID       string `json:"id,omitempty"`
+				Function struct {
+					Name      string `json:"name,omitempty"`
+					Arguments string `json:"arguments,omitempty"`
+				} `json:"function"`
+			} `json:"tool_calls,omitempty"`
+		} `json:"delta"`
+		FinishReason *string `json:"finish_reason"`
+	} `json:"choices"`
+	Usage *struct {
+		PromptTokens     int `json:"prompt_tokens"`
+		CompletionTokens int `json:"completion_tokens"`
+	} `json:"usage"`
+}
+
+// dispatchChunk decodes one OpenAI-format chunk JSON payload and fans it out
+// across cb's typed methods. "[DONE]" is handled by the caller and never
+// reaches here.
+func dispatchChunk(data string, cb TypedStreamCallback) {
+	var chunk chatCompletionChunk
+	if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+		cb.OnError(fmt.Sprintf("parse chunk: %v", err))
+		return
+	}
+
+	if chunk.Usage != nil {
+		cb.OnUsage(chunk.Usage.PromptTokens, chunk.Usage.CompletionTokens)
+	}
+	for _, choice := range chunk.Choices {
+		if choice.Delta.Content != "" || choice.Delta.Role != "" {
+			cb.OnContentDelta(choice.Delta.Role, choice.Delta.Content)
+		}
+		for _, tc := range choice.Delta.ToolCalls {
+			cb.OnToolCallDelta(tc.ID, tc.Function.Name, tc.Function.Arguments)
+		}
+		if choice.FinishReason != nil {
+			cb.OnFinish(*choice.FinishReason)
+		}
+	}
+}
+
+// VerifiedChatCompletionStreamTyped is VerifiedChatCompletionStream for
+// callers that want demultiplexed events instead of raw chunk JSON.
+func VerifiedChatCompletionStreamTyped(requestJson, apiKey string, cb TypedStreamCallback) error {
+	resp, err := doVerifiedStreamRequest(requestJson, apiKey)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var transcript strings.Builder
+	err = streamSSE(resp.Body, func(data string) bool {
+		transcript.WriteString(data)
+		if data != "[DONE]" {
+			dispatchChunk(data, cb)
+		}
+		return false
+	})
+	if err != nil {
+		cb.OnError(err.Error())
+		return err
+	}
+
+	defaultTranscript.RecordRequest(nowUnix(), requestJson, transcript.String(), extractModel(requestJson))
+	return nil
+}
+
+// ProxiedChatCompletionStreamTyped is ProxiedChatCompletionStream for
+// callers that want demultiplexed events instead of raw chunk JSON.
+func ProxiedChatCompletionStreamTyped(requestJson, proxyURL, userId, signature string, cb TypedStreamCallback) error {
+	resp, model, err := doProxiedStreamRequest(requestJson, proxyURL, userId, signature)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var transcript strings.Builder
+	err = streamSSE(resp.Body, func(data string) bool {
+		transcript.WriteString(data)
+		if data != "[DONE]" {
+			dispatchChunk(data, cb)
+		}
+		return false
+	})
+	if err != nil {
+		cb.OnError(err.Error())
+		return err
+	}
+
+	defaultTranscript.RecordRequest(nowUnix(), requestJson, transcript.String(), model)
+	return nil
+}
@@ -0,0 +1,215 @@
+package tinfoilbridge
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	tinfoilclient "github.com/tinfoilsh/tinfoil-go/verifier/client"
+)
+
+// ── AttestationTranscript ────────────────────────────────────────────
+//
+// AttestationTranscript is a hash chain binding the sequence of attestation
+// and request events this bridge has witnessed, modeled on the transcript
+// primitive used by the tapir project: each step folds the previous head
+// together with a domain-separation tag and the new item, so a party
+// holding only the final head (or a full export) can prove both the
+// ordering and the content of everything that went into it. It gives the
+// user a tamper-evident log they can present to show which enclave version
+// processed which prompts.
+
+// Domain-separation tags, one per item type folded into the chain.
+const (
+	tagEnclave     byte = 0x01
+	tagMeasurement byte = 0x02
+	tagSigstore    byte = 0x03
+	tagHPKEConfig  byte = 0x04
+	tagRequest     byte = 0x05
+)
+
+// genesisSeed is the fixed starting point of every transcript, so two
+// independently constructed transcripts that record the same events
+// produce the same head.
+var genesisSeed = sha256.Sum256([]byte("tinfoilbridge-attestation-transcript-v1"))
+
+// transcriptEntry is one link of the chain as kept in the in-memory log and
+// as serialized by Snapshot/Export.
+type transcriptEntry struct {
+	Tag  byte   `json:"tag"`
+	Item []byte `json:"item"`
+}
+
+// transcriptSnapshot is the wire format returned by Snapshot and consumed by
+// Verify: the claimed head plus the full log needed to replay it.
+type transcriptSnapshot struct {
+	Head string            `json:"head"`
+	Log  []transcriptEntry `json:"log"`
+}
+
+// AttestationTranscript maintains a running SHA-256 chain over enclave
+// attestation material and the requests it was used to authorize. The zero
+// value is not ready to use; construct one with NewAttestationTranscript.
+type AttestationTranscript struct {
+	mu      sync.Mutex
+	head    [32]byte
+	entries []transcriptEntry
+}
+
+// NewAttestationTranscript returns an empty transcript seeded from the fixed
+// genesis constant.
+func NewAttestationTranscript() *AttestationTranscript {
+	return &AttestationTranscript{head: genesisSeed}
+}
+
+// chainStep computes H_{n+1} = SHA256(H_n || tag || len(item) || item).
+func chainStep(prev [32]byte, tag byte, item []byte) [32]byte {
+	h := sha256.New()
+	h.Write(prev[:])
+	h.Write([]byte{tag})
+	var lenBuf [8]byte
+	binary.BigEndian.PutUint64(lenBuf[:], uint64(len(item)))
+	h.Write(lenBuf[:])
+	h.Write(item)
+	var out [32]byte
+	copy(out[:], h.Sum(nil))
+	return out
+}
+
+func (t *AttestationTranscript) append(tag byte, item []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.head = chainStep(t.head, tag, item)
+	t.entries = append(t.entries, transcriptEntry{Tag: tag, Item: item})
+}
+
+// RecordEnclave binds the enclave's name and repo into the chain.
+func (t *AttestationTranscript) RecordEnclave(name, repo string) {
+	t.append(tagEnclave, []byte(name+"|"+repo))
+}
+
+// RecordMeasurement binds the enclave's measurement string into the chain.
+// recordVerification passes GroundTruth.EnclaveFingerprint, the hash over the
+// measurement registers; the raw signed measurement itself is not recorded.
+func (t *AttestationTranscript) RecordMeasurement(measurement string) {
+	t.append(tagMeasurement, []byte(measurement))
+}
+
+// RecordSigstoreEntry binds the Sigstore-verified digest for this
+// verification (GroundTruth.Digest), the value the transparency log entry
+// was issued against.
+func (t *AttestationTranscript) RecordSigstoreEntry(entry string) {
+	t.append(tagSigstore, []byte(entry))
+}
+
+// RecordHPKEConfig binds the derived HPKE key config bytes produced by
+// buildOHTTPKeyConfig.
+func (t *AttestationTranscript) RecordHPKEConfig(config []byte) {
+	t.append(tagHPKEConfig, config)
+}
+
+// RecordRequest binds a {timestamp, request-hash, response-hash, model}
+// tuple into the chain. The raw request/response bodies are hashed rather
+// than stored, so the transcript itself never holds plaintext prompts.
+func (t *AttestationTranscript) RecordRequest(timestampUnix int64, requestJson, responseJson, model string) {
+	reqHash := sha256.Sum256([]byte(requestJson))
+	respHash := sha256.Sum256([]byte(responseJson))
+
+	item := make([]byte, 0, 8+32+32+len(model))
+	var tsBuf [8]byte
+	binary.BigEndian.PutUint64(tsBuf[:], uint64(timestampUnix))
+	item = append(item, tsBuf[:]...)
+	item = append(item, reqHash[:]...)
+	item = append(item, respHash[:]...)
+	item = append(item, []byte(model)...)
+
+	t.append(tagRequest, item)
+}
+
+// Snapshot returns the current head plus the serialized log, in the format
+// consumed by Verify.
+func (t *AttestationTranscript) Snapshot() []byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	snap := transcriptSnapshot{
+		Head: hex.EncodeToString(t.head[:]),
+		Log:  t.entries,
+	}
+	b, err := json.Marshal(snap)
+	if err != nil {
+		// entries are plain bytes/ints; marshaling cannot fail in practice.
+		panic(fmt.Sprintf("tinfoilbridge: marshal transcript snapshot: %v", err))
+	}
+	return b
+}
+
+// Export returns a base64-encoded Snapshot, suitable for the Android app to
+// persist locally or send off-device.
+func (t *AttestationTranscript) Export() string {
+	return base64.StdEncoding.EncodeToString(t.Snapshot())
+}
+
+// Verify replays the chain recorded in an exported transcript (the
+// base64-decoded output of Export, or a raw Snapshot) and confirms the
+// replayed head matches the head it claims, so a log altered without its
+// head being recomputed is rejected. It checks the export only against
+// itself: a log and head that were changed together still pass.
+func (t *AttestationTranscript) Verify(exported []byte) error {
+	var snap transcriptSnapshot
+	if err := json.Unmarshal(exported, &snap); err != nil {
+		return fmt.Errorf("decode transcript snapshot: %w", err)
+	}
+
+	wantHead, err := hex.DecodeString(snap.Head)
+	if err != nil {
+		return fmt.Errorf("decode transcript head: %w", err)
+	}
+
+	head := genesisSeed
+	for _, e := range snap.Log {
+		head = chainStep(head, e.Tag, e.Item)
+	}
+
+	if !bytes.Equal(head[:], wantHead) {
+		return fmt.Errorf("transcript head mismatch: chain replay does not match the claimed head")
+	}
+	return nil
+}
+
+// recordVerification binds a full verification event — enclave identity,
+// measurement, verified digest, and (once derived) the HPKE key config — into
+// the package-wide transcript. hpkeConfig may be nil if the caller hasn't
+// derived one yet (e.g. getVerifiedHTTPClient, which only pins TLS).
+func recordVerification(enclave, repo string, gt *tinfoilclient.GroundTruth, hpkeConfig []byte) {
+	defaultTranscript.RecordEnclave(enclave, repo)
+	defaultTranscript.RecordMeasurement(gt.EnclaveFingerprint)
+	defaultTranscript.RecordSigstoreEntry(gt.Digest)
+	if hpkeConfig != nil {
+		defaultTranscript.RecordHPKEConfig(hpkeConfig)
+	}
+}
+
+// ── Package-level default transcript ─────────────────────────────────
+
+var defaultTranscript = NewAttestationTranscript()
+
+// TranscriptExport returns Export() of the package-wide transcript that
+// getVerifiedHTTPClient, getEHBPTransport, and the chat completion
+// functions record into automatically.
+func TranscriptExport() string {
+	return defaultTranscript.Export()
+}
+
+// TranscriptVerify validates an exported transcript against the package-wide
+// chain's hashing rules. It does not compare against the live transcript —
+// callers wanting to confirm an export matches what this device currently
+// holds should also compare against TranscriptExport().
+func TranscriptVerify(exported []byte) error {
+	return defaultTranscript.Verify(exported)
+}
@@ -0,0 +1,419 @@
+package tinfoilbridge
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+// ── WebSocket streaming transport ────────────────────────────────────
+//
+// VerifiedChatWebSocket gives the Android app a single long-lived, TLS-pinned
+// connection for chat completions instead of a fresh SSE POST per turn, which
+// is expensive on mobile radios and doesn't survive a brief network drop.
+//
+// ProxiedChatWebSocket cannot share that design: encrypted-http-body-
+// protocol's client.Transport (the EHBP path) only exposes RoundTrip,
+// ServerIdentity, and GetSessionRecoveryToken — there is no per-blob
+// Encrypt/DecryptBody primitive to wrap an arbitrary multiplexed socket with,
+// only the ability to encrypt a single HTTP request body and decrypt its
+// matching response. So the proxied path is one cancellable EHBP-protected
+// streaming HTTP request per chat turn (the same RoundTrip-based transport
+// ProxiedChatCompletion uses), multiplexed by requestId at the application
+// level instead of over a single persistent connection.
+
+const (
+	wsBackoffInitial = 1 * time.Second
+	wsBackoffMax     = 30 * time.Second
+)
+
+// WebSocketStreamCallback extends StreamCallback with connection lifecycle
+// events that only make sense for a persistent socket rather than a
+// one-shot SSE request.
+type WebSocketStreamCallback interface {
+	StreamCallback
+	OnOpen()
+	OnClose()
+}
+
+// wsFrame is the JSON envelope exchanged over the verified-path socket in
+// both directions: requests carry Data as the chat completion request body,
+// responses carry Data as the SSE-style delta payload.
+type wsFrame struct {
+	RequestID string `json:"requestId"`
+	Data      string `json:"data,omitempty"`
+	Cancel    bool   `json:"cancel,omitempty"`
+}
+
+// chatWebSocket manages one persistent, TLS-pinned connection for the
+// verified (direct-to-enclave) path, multiplexing many concurrent chat
+// requests over it by requestId and reconnecting with backoff on disconnect.
+// It dials a single EnclavePool entry, re-verifying against that same entry
+// (and picking up whatever the pool currently has cached for it) on every
+// reconnect.
+type chatWebSocket struct {
+	entry EnclaveEntry
+	wsURL string
+
+	mu              sync.Mutex
+	httpClient      *http.Client // used for the TLS-pinned dial handshake
+	conn            *websocket.Conn
+	pending         map[string]WebSocketStreamCallback
+	lastMeasurement string
+}
+
+func newChatWebSocket(entry EnclaveEntry, wsURL string, httpClient *http.Client) *chatWebSocket {
+	return &chatWebSocket{
+		entry:           entry,
+		wsURL:           wsURL,
+		httpClient:      httpClient,
+		pending:         make(map[string]WebSocketStreamCallback),
+		lastMeasurement: CurrentAttestation().Measurement,
+	}
+}
+
+func (w *chatWebSocket) ensureConnected(ctx context.Context) error {
+	w.mu.Lock()
+	if w.conn != nil {
+		w.mu.Unlock()
+		return nil
+	}
+	w.mu.Unlock()
+	return w.dial(ctx)
+}
+
+func (w *chatWebSocket) dial(ctx context.Context) error {
+	w.mu.Lock()
+	httpClient := w.httpClient
+	w.mu.Unlock()
+
+	conn, _, err := websocket.Dial(ctx, w.wsURL, &websocket.DialOptions{HTTPClient: httpClient})
+	if err != nil {
+		return fmt.Errorf("websocket dial: %w", err)
+	}
+
+	w.mu.Lock()
+	w.conn = conn
+	w.mu.Unlock()
+
+	go w.readLoop(conn)
+	return nil
+}
+
+// readLoop runs until conn.Read errors (the peer closed the connection, or
+// the network dropped), at which point it
+// hands off to handleDisconnect and exits. There is no separate teardown
+// signal: a stale readLoop from a connection no one holds a reference to
+// anymore will simply block on Read until that Read itself fails.
+func (w *chatWebSocket) readLoop(conn *websocket.Conn) {
+	for {
+		_, raw, err := conn.Read(context.Background())
+		if err != nil {
+			w.handleDisconnect()
+			return
+		}
+
+		var frame wsFrame
+		if err := json.Unmarshal(raw, &frame); err != nil {
+			w.broadcastError(fmt.Sprintf("decode frame: %v", err))
+			continue
+		}
+
+		cb := w.callbackFor(frame.RequestID)
+		if cb == nil {
+			continue
+		}
+		if frame.Data == "[DONE]" {
+			cb.OnData("[DONE]")
+			w.forget(frame.RequestID)
+			continue
+		}
+		if abort := cb.OnData(frame.Data); abort {
+			w.Cancel(frame.RequestID)
+		}
+	}
+}
+
+func (w *chatWebSocket) callbackFor(requestID string) WebSocketStreamCallback {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.pending[requestID]
+}
+
+func (w *chatWebSocket) forget(requestID string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.pending, requestID)
+}
+
+func (w *chatWebSocket) broadcastError(msg string) {
+	w.mu.Lock()
+	cbs := make([]WebSocketStreamCallback, 0, len(w.pending))
+	for _, cb := range w.pending {
+		cbs = append(cbs, cb)
+	}
+	w.mu.Unlock()
+	for _, cb := range cbs {
+		cb.OnError(msg)
+	}
+}
+
+// handleDisconnect drops the dead connection and re-establishes it with
+// exponential backoff, re-running attestation on reconnect so a measurement
+// change mid-session surfaces to every pending callback.
+func (w *chatWebSocket) handleDisconnect() {
+	w.mu.Lock()
+	w.conn = nil
+	cbs := make([]WebSocketStreamCallback, 0, len(w.pending))
+	for _, cb := range w.pending {
+		cbs = append(cbs, cb)
+	}
+	w.mu.Unlock()
+
+	for _, cb := range cbs {
+		cb.OnClose()
+	}
+
+	go w.reconnectWithBackoff()
+}
+
+func (w *chatWebSocket) reconnectWithBackoff() {
+	backoff := wsBackoffInitial
+	for {
+		if err := w.reverifyAndDial(); err == nil {
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > wsBackoffMax {
+			backoff = wsBackoffMax
+		}
+	}
+}
+
+// reverifyAndDial re-runs attestation against w.entry through the currently
+// active pool before reconnecting, so a rotated enclave is caught at the
+// transport layer rather than silently trusted. It looks up getActivePool()
+// fresh rather than a pool captured at construction time, so a
+// RegisterEnclavePool swap takes effect on the very next reconnect even if
+// the new pool's primary entry happens to share the old one's Name.
+func (w *chatWebSocket) reverifyAndDial() error {
+	pool := getActivePool()
+	entry := w.entry
+	if primary, ok := pool.primaryEntry(); ok && primary.Name == entry.Name {
+		entry = primary
+	}
+	pool.invalidate(entry.Name)
+
+	httpClient, err := pool.verifiedClientFor(entry)
+	if err != nil {
+		return fmt.Errorf("reattest (%s): %w", entry.Name, err)
+	}
+	w.mu.Lock()
+	w.httpClient = httpClient
+	w.mu.Unlock()
+
+	newMeasurement := CurrentAttestation().Measurement
+	w.mu.Lock()
+	old := w.lastMeasurement
+	w.lastMeasurement = newMeasurement
+	w.mu.Unlock()
+	if old != "" && old != newMeasurement {
+		w.broadcastError(fmt.Sprintf("enclave measurement changed on reconnect: %s -> %s", old, newMeasurement))
+	}
+
+	if err := w.dial(context.Background()); err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	cbs := make([]WebSocketStreamCallback, 0, len(w.pending))
+	for _, cb := range w.pending {
+		cbs = append(cbs, cb)
+	}
+	w.mu.Unlock()
+	for _, cb := range cbs {
+		cb.OnOpen()
+	}
+	return nil
+}
+
+// send registers cb under requestID and writes the chat request frame.
+func (w *chatWebSocket) send(ctx context.Context, requestID, requestJson string, cb WebSocketStreamCallback) error {
+	if err := w.ensureConnected(ctx); err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	w.pending[requestID] = cb
+	conn := w.conn
+	w.mu.Unlock()
+	if conn == nil {
+		return fmt.Errorf("websocket not connected")
+	}
+
+	raw, err := json.Marshal(wsFrame{RequestID: requestID, Data: requestJson})
+	if err != nil {
+		return fmt.Errorf("encode frame: %w", err)
+	}
+
+	cb.OnOpen()
+	return conn.Write(ctx, websocket.MessageText, raw)
+}
+
+// Cancel stops dispatching to requestID's callback and tells the server to
+// abandon that in-flight completion.
+func (w *chatWebSocket) Cancel(requestID string) {
+	w.mu.Lock()
+	w.cancelLocked(requestID)
+	w.mu.Unlock()
+}
+
+// cancelLocked must be called with w.mu held.
+func (w *chatWebSocket) cancelLocked(requestID string) {
+	conn := w.conn
+	delete(w.pending, requestID)
+	if conn == nil {
+		return
+	}
+
+	raw, err := json.Marshal(wsFrame{RequestID: requestID, Cancel: true})
+	if err != nil {
+		return
+	}
+	_ = conn.Write(context.Background(), websocket.MessageText, raw)
+}
+
+// ── Package-level singletons ──────────────────────────────────────────
+
+var (
+	verifiedWSMu sync.Mutex
+	verifiedWS   *chatWebSocket
+
+	proxiedStreamsMu sync.Mutex
+	proxiedStreams   map[string]context.CancelFunc // keyed by proxiedStreamKey(proxyURL, requestId)
+)
+
+func toWebSocketURL(httpURL string) string {
+	switch {
+	case strings.HasPrefix(httpURL, "https://"):
+		return "wss://" + strings.TrimPrefix(httpURL, "https://")
+	case strings.HasPrefix(httpURL, "http://"):
+		return "ws://" + strings.TrimPrefix(httpURL, "http://")
+	default:
+		return httpURL
+	}
+}
+
+// VerifiedChatWebSocket sends a chat completion request over the single
+// long-lived, TLS-pinned connection to the active pool's primary enclave,
+// reusing the Tinfoil-verified HTTP client for the handshake. Token deltas
+// are dispatched to cb as they arrive; the call returns once the request
+// frame has been written, not once the completion finishes. Cancel in-flight
+// work with CancelVerifiedChatWebSocket.
+func VerifiedChatWebSocket(requestId, requestJson string, cb WebSocketStreamCallback) error {
+	pool := getActivePool()
+	entry, ok := pool.primaryEntry()
+	if !ok {
+		return fmt.Errorf("no enclaves configured")
+	}
+	httpClient, err := pool.verifiedClientFor(entry)
+	if err != nil {
+		return err
+	}
+
+	verifiedWSMu.Lock()
+	if verifiedWS == nil || verifiedWS.entry.Name != entry.Name {
+		verifiedWS = newChatWebSocket(entry, toWebSocketURL(entry.APIBase)+"/chat/completions/ws", httpClient)
+	}
+	ws := verifiedWS
+	verifiedWSMu.Unlock()
+
+	return ws.send(context.Background(), requestId, requestJson, cb)
+}
+
+// CancelVerifiedChatWebSocket cancels a request previously started with
+// VerifiedChatWebSocket.
+func CancelVerifiedChatWebSocket(requestId string) {
+	verifiedWSMu.Lock()
+	ws := verifiedWS
+	verifiedWSMu.Unlock()
+	if ws != nil {
+		ws.Cancel(requestId)
+	}
+}
+
+func proxiedStreamKey(proxyURL, requestId string) string {
+	return proxyURL + "|" + requestId
+}
+
+// ProxiedChatWebSocket sends an EHBP-encrypted chat completion request
+// through a proxy server, giving it the same WebSocketStreamCallback shape
+// (OnOpen/OnData/OnError/OnClose) as VerifiedChatWebSocket even though,
+// unlike the verified path, there's no persistent socket underneath: each
+// call runs the EHBP-protected streaming request (dialProxied, the same
+// RoundTrip-based transport ProxiedChatCompletion uses) on its own
+// goroutine, cancellable by requestId via CancelProxiedChatWebSocket. The
+// body is still end-to-end encrypted between this client and the enclave —
+// the proxy sees only metadata headers — it's just carried over one HTTP
+// request per turn rather than one frame on a shared connection.
+func ProxiedChatWebSocket(requestId, requestJson, proxyURL, userId, signature string, cb WebSocketStreamCallback) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	key := proxiedStreamKey(proxyURL, requestId)
+
+	proxiedStreamsMu.Lock()
+	if proxiedStreams == nil {
+		proxiedStreams = make(map[string]context.CancelFunc)
+	}
+	proxiedStreams[key] = cancel
+	proxiedStreamsMu.Unlock()
+
+	go func() {
+		defer func() {
+			proxiedStreamsMu.Lock()
+			delete(proxiedStreams, key)
+			proxiedStreamsMu.Unlock()
+			cancel()
+			cb.OnClose()
+		}()
+
+		cb.OnOpen()
+		resp, model, err := dialProxied(ctx, getActivePool(), requestJson, proxyURL, userId, signature)
+		if err != nil {
+			cb.OnError(err.Error())
+			return
+		}
+		defer resp.Body.Close()
+
+		var transcript strings.Builder
+		err = streamSSE(resp.Body, func(data string) bool {
+			transcript.WriteString(data)
+			return cb.OnData(data)
+		})
+		if err != nil {
+			cb.OnError(err.Error())
+			return
+		}
+		defaultTranscript.RecordRequest(nowUnix(), requestJson, transcript.String(), model)
+	}()
+
+	return nil
+}
+
+// CancelProxiedChatWebSocket cancels a request previously started with
+// ProxiedChatWebSocket against the same proxyURL.
+func CancelProxiedChatWebSocket(proxyURL, requestId string) {
+	key := proxiedStreamKey(proxyURL, requestId)
+	proxiedStreamsMu.Lock()
+	cancel := proxiedStreams[key]
+	proxiedStreamsMu.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+}